@@ -4,51 +4,526 @@ import (
 	"context"
 	"encoding/binary"
 	"io"
+	"math/rand"
 	"net"
 	"sync"
 	"time"
 
+	"github.com/pierrec/lz4/v4"
 	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+// State is the connectivity state of a Client.
+type State int
+
+// Possible Client states.
+const (
+	StateConnected State = iota
+	StateReconnecting
+	StateClosed
+)
+
+// ErrReconnecting is returned by Call when the client is in the process of
+// redialing the server after a lost connection. Callers should retry, since
+// the underlying connection is not usable yet.
+var ErrReconnecting = errors.New("client is reconnecting")
+
+// reconnectInitialBackoff is the delay before the first redial attempt after
+// a connection is lost. Subsequent attempts double it, up to
+// Client.heartbeatTimeout.
+const reconnectInitialBackoff = 100 * time.Millisecond
+
+// defaultMaxMessageSize is the hard ceiling on a single message body, used
+// when Client.MaxMessageSize is unset. Mirrors syncthing's BEP frame size
+// limit, which exists for the same reason: without it a corrupt or hostile
+// peer can make us allocate unbounded memory from a single header.
+const defaultMaxMessageSize = 500 * 1024 * 1024
+
+// recvChunkSize is the size of the slices recvChunked reads into. Large
+// transfers are read in chunks of this size rather than in one recvPeek
+// call, so progress can be logged while it's in flight instead of the
+// caller blocking silently until the whole frame lands.
+const recvChunkSize = 64 * 1024
+
+// recvProgressLogThreshold is the body size above which recvChunked logs
+// progress. Small and medium messages are read in a single recvPeek call.
+const recvProgressLogThreshold = 16 * 1024 * 1024
+
+// largeBodyPool recycles the buffers used for message bodies that don't fit
+// in Message.body1's static array, so that decoding a big ROWS response
+// doesn't retain memory forever.
+var largeBodyPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 0)
+	},
+}
+
+// Bits of the header flags byte.
+const (
+	// flagCompressed marks a message body as LZ4-compressed, framed as
+	// <uint32 uncompressed_size><lz4 block>.
+	flagCompressed byte = 1 << 0
+)
+
+// compressionThreshold is the minimum combined body size above which a
+// message is compressed, when compression is enabled. Small bodies are left
+// alone since the LZ4 framing overhead and CPU cost aren't worth it.
+const compressionThreshold = 4096
+
 // Client connecting to a dqlite server and speaking the dqlite wire protocol.
 type Client struct {
 	logger           *zap.Logger   // Logger.
 	address          string        // Address of the connected dqlite server.
 	store            ServerStore   // Update this store upon heartbeats.
+	dial             DialFunc      // Used to redial the server upon reconnection.
 	conn             net.Conn      // Underlying network connection.
 	heartbeatTimeout time.Duration // Heartbeat timeout reported at registration.
 	closeCh          chan struct{} // Stops the heartbeat when the connection gets closed
-	mu               sync.Mutex    // Serialize requests
+	mu               sync.Mutex    // Serialize requests, and guard the fields below
+	compression      bool          // Whether the server accepted our compression capability
+	state            State         // Current connectivity state
+	generation       uint64        // Bumped every time state changes; not otherwise read by the client
+	onStateChange    func(old, new State)
+
+	// MaxMessageSize caps the size of a single message body accepted from
+	// the server. Zero means defaultMaxMessageSize.
+	MaxMessageSize int
+
+	// poisonErr is set when a Call was aborted by a context deadline or
+	// cancellation while a frame was only partially read. Since dqlite
+	// doesn't tag requests, that frame can't be recovered, so every
+	// subsequent Call fails fast with this error until reconnect() dials
+	// a fresh connection.
+	poisonErr error
+
+	// pipelining is negotiated at capabilities exchange time. When true,
+	// callPipelined tags requests with an id and a single reader goroutine
+	// demuxes responses, letting multiple Calls share the connection
+	// concurrently instead of serializing through mu for the whole
+	// round-trip.
+	pipelining       bool
+	nextRequestID    uint16
+	readerStarted    bool
+	readerGeneration uint64 // Bumped each time a new reader goroutine is actually started
+	inFlightSem      chan struct{}
+
+	pendingMu sync.Mutex // Guards pending, independently of mu since the reader goroutine runs concurrently with Call
+	pending   map[uint16]pendingCall
+
+	// KeepaliveInterval, when non-zero, enables periodic ping/pong liveness
+	// probes on this idle interval, independent of heartbeatTimeout (which
+	// is a server-driven gossip interval, not a TCP liveness check). This is
+	// what keeps the connection alive through NAT/firewalls that silently
+	// drop idle TCP sessions well before the heartbeat would next fire.
+	KeepaliveInterval time.Duration
+
+	// KeepaliveTimeout bounds how long a ping can go unanswered before the
+	// connection is considered dead. Zero means defaultKeepaliveTimeout.
+	KeepaliveTimeout time.Duration
+
+	// KeepalivePadding caps the random padding, in bytes, attached to each
+	// ping so fixed-size heartbeat frames can't be fingerprinted by
+	// traffic analysis. Zero means defaultKeepalivePadding.
+	KeepalivePadding int
+}
+
+// defaultKeepaliveTimeout is used when KeepaliveTimeout is unset.
+const defaultKeepaliveTimeout = 5 * time.Second
+
+// defaultKeepalivePadding is used when KeepalivePadding is unset.
+const defaultKeepalivePadding = 255
+
+// pendingCall is a callPipelined invocation waiting for the reader goroutine
+// to demux its response.
+type pendingCall struct {
+	response *Message
+	done     chan error
 }
 
-func newClient(conn net.Conn, address string, store ServerStore, logger *zap.Logger) *Client {
+// maxPipelinedRequests bounds how many pipelined calls can be in flight on a
+// connection at once, applying backpressure rather than letting callers
+// queue unboundedly.
+const maxPipelinedRequests = 64
+
+func newClient(conn net.Conn, address string, store ServerStore, dial DialFunc, logger *zap.Logger) *Client {
 	client := &Client{
-		conn:    conn,
-		address: address,
-		store:   store,
-		logger:  logger.With(zap.String("target", address)),
-		closeCh: make(chan struct{}),
+		conn:        conn,
+		address:     address,
+		store:       store,
+		dial:        dial,
+		logger:      logger.With(zap.String("target", address)),
+		closeCh:     make(chan struct{}),
+		state:       StateConnected,
+		inFlightSem: make(chan struct{}, maxPipelinedRequests),
+		pending:     make(map[uint16]pendingCall),
 	}
 
 	return client
 }
 
+// State returns the current connectivity state of the client.
+func (c *Client) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// OnStateChange registers a callback invoked whenever the client transitions
+// between StateConnected, StateReconnecting and StateClosed. Useful for
+// upper layers (e.g. the driver connection pool) that want to pause SQL
+// traffic while a reconnection is in progress.
+func (c *Client) OnStateChange(f func(old, new State)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onStateChange = f
+}
+
+// setState transitions to state, bumping the generation counter and firing
+// the OnStateChange callback (outside of the lock) if registered.
+func (c *Client) setState(state State) {
+	c.mu.Lock()
+	old := c.state
+	if old == state {
+		c.mu.Unlock()
+		return
+	}
+	c.state = state
+	c.generation++
+	cb := c.onStateChange
+	c.mu.Unlock()
+
+	if cb != nil {
+		cb(old, state)
+	}
+}
+
+// negotiateCapabilities exchanges a capabilities request with the server
+// right after the protocol version handshake. Servers predating this
+// negotiation don't recognize the request type and the call fails, in which
+// case we fall back to the uncompressed wire format used so far.
+//
+// This is also called by reconnect() while the client is still in
+// StateReconnecting, i.e. before it's eligible to take the regular Call
+// path; it uses callDuringHandshake instead of Call for that reason.
+func (c *Client) negotiateCapabilities(ctx context.Context) error {
+	request := Message{}
+	request.Init(16)
+	response := Message{}
+	response.Init(16)
+
+	EncodeCapabilities(&request)
+
+	// Reset to the pre-negotiation default before attempting it, the same
+	// way reconnect() resets pipelining via resetPipelineState: if this
+	// negotiation fails (server predates it, or this reconnect dialed a
+	// different, less capable cluster member), compression must not be
+	// left at whatever the previous connection happened to negotiate.
+	c.mu.Lock()
+	c.compression = false
+	c.mu.Unlock()
+
+	if err := c.callDuringHandshake(ctx, &request, &response); err != nil {
+		c.logger.Debug("capabilities negotiation not supported by server, disabling compression")
+		return nil
+	}
+
+	capabilities, err := DecodeCapabilities(&response)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode capabilities response")
+	}
+
+	c.mu.Lock()
+	c.compression = capabilities.Compression
+	c.pipelining = capabilities.Pipelining
+	c.mu.Unlock()
+
+	if c.pipelining {
+		c.startPipelineReader()
+	}
+
+	return nil
+}
+
+// startPipelineReader launches the single reader goroutine that demuxes
+// pipelined responses, unless one is already running for the current
+// connection.
+func (c *Client) startPipelineReader() {
+	c.mu.Lock()
+	if c.readerStarted {
+		c.mu.Unlock()
+		return
+	}
+	c.readerStarted = true
+	c.readerGeneration++
+	gen := c.readerGeneration
+	c.mu.Unlock()
+
+	go c.pipelineReaderLoop(gen)
+}
+
+// pipelineReaderLoop reads response frames as they arrive, in whatever order
+// the server sends them, and hands each one to the callPipelined invocation
+// waiting on its request id. It runs until the connection errors, at which
+// point it fans that error out to every still-pending call. gen identifies
+// which startPipelineReader call spawned this goroutine, so a stale reader
+// left over from a connection reconnect() has already torn down can't
+// clobber a newer one's state.
+func (c *Client) pipelineReaderLoop(gen uint64) {
+	for {
+		header := Message{}
+		if err := c.recvHeader(&header); err != nil {
+			c.failPipeline(gen, errors.Wrap(err, "failed to receive header"))
+			return
+		}
+
+		c.pendingMu.Lock()
+		call, ok := c.pending[header.extra]
+		if ok {
+			delete(c.pending, header.extra)
+		}
+		c.pendingMu.Unlock()
+
+		if !ok {
+			// The caller gave up (ctx cancelled) before the response
+			// arrived; drain and discard the body so the stream stays in
+			// sync for the next frame. recvBody sizes the read off
+			// discard.words/flags, not header.words/flags directly, so
+			// those have to be copied over the same way the matched-call
+			// branch below does, or it reads zero bytes and leaves the
+			// real body sitting in the socket for the next recvHeader to
+			// misread as a header.
+			discard := Message{}
+			discard.Init(int(header.words) * messageWordSize)
+			discard.words = header.words
+			discard.mtype = header.mtype
+			discard.flags = header.flags
+			discard.extra = header.extra
+			if err := c.recvBody(&discard); err != nil {
+				c.failPipeline(gen, errors.Wrap(err, "failed to receive body"))
+				return
+			}
+			continue
+		}
+
+		call.response.words = header.words
+		call.response.mtype = header.mtype
+		call.response.flags = header.flags
+		call.response.extra = header.extra
+
+		err := c.recvBody(call.response)
+		call.done <- err
+		if err != nil {
+			c.failPipeline(gen, errors.Wrap(err, "failed to receive body"))
+			return
+		}
+	}
+}
+
+// failPipeline fans err out to every call still waiting on a response, but
+// only if gen still identifies the active reader: reconnect() tears down
+// pipelining synchronously as soon as it notices a dead connection, without
+// waiting for this goroutine to notice the same thing, and may already have
+// started a newer reader (with a newer generation) for a freshly dialed
+// connection by the time this one gets here. In that case there is nothing
+// left for this call to do.
+func (c *Client) failPipeline(gen uint64, err error) {
+	c.mu.Lock()
+	if gen != c.readerGeneration {
+		c.mu.Unlock()
+		return
+	}
+	c.readerStarted = false
+	c.mu.Unlock()
+
+	c.pendingMu.Lock()
+	pending := c.pending
+	c.pending = make(map[uint16]pendingCall)
+	c.pendingMu.Unlock()
+
+	for _, call := range pending {
+		select {
+		case call.done <- err:
+		default:
+		}
+	}
+}
+
+// resetPipelineState disables pipelining and fails every pending call with
+// err. Called by reconnect() as soon as a connection is known to be dead:
+// none of those calls can be satisfied by it, and there's no reason to wait
+// for the reader goroutine (if one is running) to reach the same
+// conclusion on its own via failPipeline.
+func (c *Client) resetPipelineState(err error) {
+	c.mu.Lock()
+	c.pipelining = false
+	c.readerStarted = false
+	c.mu.Unlock()
+
+	c.pendingMu.Lock()
+	pending := c.pending
+	c.pending = make(map[uint16]pendingCall)
+	c.pendingMu.Unlock()
+
+	for _, call := range pending {
+		select {
+		case call.done <- err:
+		default:
+		}
+	}
+}
+
 // Call invokes a dqlite RPC, sending a request message and receiving a
 // response message.
+//
+// If the server negotiated the pipelining capability, the call is tagged
+// with a request id and dispatched concurrently with other in-flight calls;
+// otherwise it falls back to the mutex-serialized request/response path.
 func (c *Client) Call(ctx context.Context, request, response *Message) error {
+	c.mu.Lock()
+	pipelining := c.pipelining
+	c.mu.Unlock()
+
+	if pipelining {
+		return c.callPipelined(ctx, request, response)
+	}
+
+	return c.callSerialized(ctx, request, response)
+}
+
+// callPipelined tags request with a fresh id in the header's extra field and
+// hands it to the single reader goroutine (started by negotiateCapabilities)
+// to demux, so that multiple Calls can have requests in flight on the same
+// connection at once. A bounded semaphore applies backpressure once
+// maxPipelinedRequests calls are outstanding.
+func (c *Client) callPipelined(ctx context.Context, request, response *Message) error {
+	select {
+	case c.inFlightSem <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	defer func() { <-c.inFlightSem }()
+
+	c.mu.Lock()
+	if c.state != StateConnected {
+		c.mu.Unlock()
+		return ErrReconnecting
+	}
+	if c.poisonErr != nil {
+		err := c.poisonErr
+		c.mu.Unlock()
+		return err
+	}
+
+	id := c.nextRequestID
+	c.nextRequestID++
+	c.setRequestID(request, id)
+
+	call := pendingCall{response: response, done: make(chan error, 1)}
+	c.pendingMu.Lock()
+	c.pending[id] = call
+	c.pendingMu.Unlock()
+
+	err := c.send(request)
+	c.mu.Unlock()
+
+	if err != nil {
+		c.pendingMu.Lock()
+		delete(c.pending, id)
+		c.pendingMu.Unlock()
+		return errors.Wrap(err, "failed to send request")
+	}
+
+	select {
+	case err := <-call.done:
+		return err
+	case <-ctx.Done():
+		// The response may never arrive (or the connection may just sit
+		// idle), so don't leave call's entry in pending forever: scrub it
+		// now. Compare by channel identity rather than blindly deleting by
+		// id, since the reader goroutine may have already popped this
+		// entry and, with id reused, have it replaced by an unrelated
+		// later call by the time we get the lock.
+		c.pendingMu.Lock()
+		if cur, ok := c.pending[id]; ok && cur.done == call.done {
+			delete(c.pending, id)
+		}
+		c.pendingMu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// setRequestID tags request with id by writing it into the two bytes of the
+// header's extra field, without disturbing the rest of the header.
+func (c *Client) setRequestID(req *Message, id uint16) {
+	req.extra = id
+	binary.LittleEndian.PutUint16(req.header[6:], id)
+}
+
+func (c *Client) callSerialized(ctx context.Context, request, response *Message) error {
 	// We need to take a lock since the dqlite server currently does not
 	// support concurrent requests.
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// TODO: honor ctx
+	if c.state != StateConnected {
+		return ErrReconnecting
+	}
+	if c.poisonErr != nil {
+		return c.poisonErr
+	}
+
+	return c.doCall(ctx, request, response)
+}
+
+// callDuringHandshake performs a Call while the client is still in
+// StateReconnecting, for use by negotiateCapabilities only: the regular
+// connectivity gate in callSerialized/callPipelined would otherwise reject
+// it with ErrReconnecting, since the client isn't considered StateConnected
+// until the handshake that this very call is part of has completed.
+func (c *Client) callDuringHandshake(ctx context.Context, request, response *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.doCall(ctx, request, response)
+}
+
+// doCall sends request and receives response over c.conn, honoring ctx's
+// deadline and cancellation. Callers must hold c.mu.
+func (c *Client) doCall(ctx context.Context, request, response *Message) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := c.conn.SetDeadline(deadline); err != nil {
+			return errors.Wrap(err, "failed to set deadline")
+		}
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	// If ctx is cancelled while send/recv are blocked in a read or write,
+	// force them to return by pushing the deadline into the past: there is
+	// no per-request tag to interrupt otherwise.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
 	if err := c.send(request); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			c.poisonErr = ctxErr
+			return ctxErr
+		}
 		return errors.Wrap(err, "failed to send request")
 	}
 
 	if err := c.recv(response); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			c.poisonErr = ctxErr
+			return ctxErr
+		}
 		return errors.Wrap(err, "failed to receive response")
 	}
 
@@ -58,10 +533,24 @@ func (c *Client) Call(ctx context.Context, request, response *Message) error {
 // Close the client connection.
 func (c *Client) Close() error {
 	close(c.closeCh)
-	return c.conn.Close()
+	c.setState(StateClosed)
+
+	// c.conn is reassigned by reconnect() under c.mu; read it under the
+	// same lock rather than racing that goroutine.
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	return conn.Close()
 }
 
 func (c *Client) send(req *Message) error {
+	if c.compression {
+		if err := c.compressBody(req); err != nil {
+			return errors.Wrap(err, "failed to compress body")
+		}
+	}
+
 	if err := c.sendHeader(req); err != nil {
 		return errors.Wrap(err, "failed to send header")
 	}
@@ -73,6 +562,56 @@ func (c *Client) send(req *Message) error {
 	return nil
 }
 
+// compressBody replaces req's body with its LZ4-compressed form when the
+// combined body1+body2 payload is large enough to be worth it, and sets the
+// flagCompressed bit accordingly. Small bodies are left untouched.
+func (c *Client) compressBody(req *Message) error {
+	plain := req.body1.Bytes[:req.body1.Offset]
+	if req.body2.Bytes != nil {
+		plain = append(append([]byte{}, plain...), req.body2.Bytes[:req.body2.Offset]...)
+	}
+
+	if len(plain) <= compressionThreshold {
+		req.flags &^= flagCompressed
+		req.header[5] = req.flags
+		return nil
+	}
+
+	compressed := make([]byte, lz4.CompressBlockBound(len(plain)))
+	var compressor lz4.Compressor
+	n, err := compressor.CompressBlock(plain, compressed)
+	if err != nil {
+		return errors.Wrap(err, "failed to lz4-compress body")
+	}
+	compressed = compressed[:n]
+
+	framed := make([]byte, 4+len(compressed))
+	binary.LittleEndian.PutUint32(framed, uint32(len(plain)))
+	copy(framed[4:], compressed)
+
+	// Pad to a whole number of words, as required by the header's words
+	// count.
+	if pad := len(framed) % messageWordSize; pad != 0 {
+		framed = append(framed, make([]byte, messageWordSize-pad)...)
+	}
+
+	req.body1.Offset = 0
+	req.body2.Bytes = framed
+	req.body2.Offset = len(framed)
+	req.words = uint32(len(framed) / messageWordSize)
+	req.flags |= flagCompressed
+
+	// sendHeader writes req.header verbatim, not the parsed words/flags
+	// fields, so the new word count and flags byte have to be patched into
+	// the raw header bytes here (the same way setRequestID patches extra)
+	// or the peer will wait on a stale, pre-compression word count for a
+	// shorter body that's already finished arriving.
+	binary.LittleEndian.PutUint32(req.header[0:], req.words)
+	req.header[5] = req.flags
+
+	return nil
+}
+
 func (c *Client) sendHeader(req *Message) error {
 	n, err := c.conn.Write(req.header[:])
 	if err != nil {
@@ -142,13 +681,175 @@ func (c *Client) recvHeader(res *Message) error {
 func (c *Client) recvBody(res *Message) error {
 	n := int(res.words) * messageWordSize
 
-	// TODO: handle n > 4096 (i.e. static buffer size)
-	buf := res.body1.Bytes[:n]
+	buf, err := c.allocBody(res, n)
+	if err != nil {
+		return errors.Wrap(err, "failed to allocate body")
+	}
 
-	if err := c.recvPeek(buf); err != nil {
+	if err := c.recvChunked(buf); err != nil {
 		return errors.Wrap(err, "failed to read body")
 	}
 
+	if res.flags&flagCompressed != 0 {
+		if err := c.decompressBody(res, buf); err != nil {
+			return errors.Wrap(err, "failed to decompress body")
+		}
+	}
+
+	return nil
+}
+
+// allocBody returns a buffer of n bytes to receive a message body into:
+// res.body1's static array when it fits, or a pooled/grown res.body2
+// buffer otherwise, capped at maxMessageSize to reject hostile oversized
+// frames. Any res.body2 buffer left over from a previous use of res is
+// returned to the pool once it's no longer needed.
+func (c *Client) allocBody(res *Message, n int) ([]byte, error) {
+	if n <= len(res.body1.Bytes) {
+		c.releaseBody(res)
+		return res.body1.Bytes[:n], nil
+	}
+
+	max := c.maxMessageSize()
+	if n > max {
+		return nil, errors.Errorf("message body of %d bytes exceeds maximum of %d", n, max)
+	}
+
+	buf := c.newBodyBuffer(n)
+	c.releaseBody(res)
+	res.body2.Bytes = buf
+	res.body2.Offset = 0
+
+	return buf, nil
+}
+
+// newBodyBuffer returns a buffer of n bytes backed by largeBodyPool,
+// growing to the next power of two so the pool settles into a small number
+// of reusable size classes.
+func (c *Client) newBodyBuffer(n int) []byte {
+	size := nextPowerOfTwo(n)
+
+	buf := largeBodyPool.Get().([]byte)
+	if cap(buf) < size {
+		buf = make([]byte, size)
+	} else {
+		buf = buf[:size]
+	}
+
+	return buf[:n]
+}
+
+// releaseBody returns res.body2's buffer, if any, to largeBodyPool.
+func (c *Client) releaseBody(res *Message) {
+	if res.body2.Bytes == nil {
+		return
+	}
+	largeBodyPool.Put(res.body2.Bytes) // nolint:staticcheck // size varies, pool just recycles capacity
+	res.body2.Bytes = nil
+	res.body2.Offset = 0
+}
+
+func (c *Client) maxMessageSize() int {
+	if c.MaxMessageSize > 0 {
+		return c.MaxMessageSize
+	}
+	return defaultMaxMessageSize
+}
+
+// nextPowerOfTwo rounds n up to the next power of two, so pooled buffers
+// settle into a small number of reusable size classes.
+func nextPowerOfTwo(n int) int {
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	return size
+}
+
+// recvChunked reads buf in recvChunkSize slices instead of a single
+// recvPeek call, logging progress for transfers above
+// recvProgressLogThreshold so a single huge frame doesn't read as a silent
+// stall.
+func (c *Client) recvChunked(buf []byte) error {
+	if len(buf) <= recvProgressLogThreshold {
+		return c.recvPeek(buf)
+	}
+
+	for offset := 0; offset < len(buf); {
+		end := offset + recvChunkSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+
+		if err := c.recvPeek(buf[offset:end]); err != nil {
+			return err
+		}
+
+		offset = end
+		c.logger.Debug("receiving large message", zap.Int("received", offset), zap.Int("total", len(buf)))
+	}
+
+	return nil
+}
+
+// decompressBody replaces the just-received framed buffer (<uint32
+// uncompressed_size><lz4 block>) with its decompressed contents, in
+// res.body1 when they fit its static buffer and in res.body2 otherwise, so
+// the existing decoders can read it as before.
+func (c *Client) decompressBody(res *Message, framed []byte) error {
+	if len(framed) < 4 {
+		return errors.New("compressed body shorter than its size prefix")
+	}
+
+	size := int(binary.LittleEndian.Uint32(framed))
+
+	max := c.maxMessageSize()
+	if size > max {
+		return errors.Errorf("decompressed body of %d bytes exceeds maximum of %d", size, max)
+	}
+
+	// framed may be res.body1.Bytes itself (allocBody returns it directly
+	// when the received frame fits the static buffer), so decompressing
+	// straight into res.body1.Bytes would have lz4's write cursor (starting
+	// at offset 0) race ahead of and clobber its own read cursor (starting
+	// at offset 4) partway through. Always decompress into a scratch buffer
+	// that can't alias framed, then place the result afterwards.
+	scratch := c.newBodyBuffer(size)
+
+	// compressBody zero-pads the frame to a whole number of words, and an
+	// LZ4 block has no end marker of its own, so the padding would be parsed
+	// as a further (invalid) sequence. Strip up to messageWordSize-1
+	// trailing zero bytes until the block decodes to exactly size bytes.
+	block := framed[4:]
+	var n int
+	var err error
+	for pad := 0; pad < messageWordSize && pad < len(block); pad++ {
+		if pad > 0 && block[len(block)-pad] != 0 {
+			break
+		}
+		n, err = lz4.UncompressBlock(block[:len(block)-pad], scratch)
+		if err == nil && n == size {
+			break
+		}
+	}
+	if err != nil {
+		largeBodyPool.Put(scratch) // nolint:staticcheck // size varies, pool just recycles capacity
+		return errors.Wrap(err, "failed to lz4-decompress body")
+	}
+	if n != size {
+		largeBodyPool.Put(scratch) // nolint:staticcheck // size varies, pool just recycles capacity
+		return errors.Errorf("decompressed %d bytes, expected %d", n, size)
+	}
+
+	c.releaseBody(res)
+	if size <= len(res.body1.Bytes) {
+		copy(res.body1.Bytes[:size], scratch[:size])
+		largeBodyPool.Put(scratch) // nolint:staticcheck // size varies, pool just recycles capacity
+	} else {
+		res.body2.Bytes = scratch
+		res.body2.Offset = 0
+	}
+
 	return nil
 }
 
@@ -186,6 +887,10 @@ func (c *Client) recvFill(buf []byte) (int, error) {
 }
 
 func (c *Client) heartbeat() {
+	if c.KeepaliveInterval > 0 {
+		go c.keepaliveLoop()
+	}
+
 	request := Message{}
 	request.Init(16)
 	response := Message{}
@@ -208,20 +913,224 @@ func (c *Client) heartbeat() {
 		err := c.Call(ctx, &request, &response)
 		cancel()
 
-		// We bail out upon failures.
-		//
-		// TODO: make the client survive temporary disconnections.
 		if err != nil {
-			return
+			if err == ErrReconnecting {
+				// A reconnection started by the keepalive loop is
+				// already under way.
+				continue
+			}
+
+			if !c.reconnect() {
+				// The client was closed while we were trying to
+				// reconnect.
+				return
+			}
+
+			continue
 		}
 
 		addresses, err := DecodeServers(&response)
 		if err != nil {
-			return
+			c.logger.Error("failed to decode heartbeat response", zap.Error(err))
+			continue
 		}
 
 		if err := c.store.Set(ctx, addresses); err != nil {
+			c.logger.Error("failed to update server store", zap.Error(err))
+		}
+	}
+}
+
+// reconnect closes the current connection, transitions to StateReconnecting
+// and keeps redialing c.address with exponential backoff (jittered, capped
+// at c.heartbeatTimeout) until a new connection is established and the
+// protocol handshake completes, or the client is closed. Returns false in
+// the latter case.
+func (c *Client) reconnect() bool {
+	c.mu.Lock()
+	if c.state == StateClosed {
+		c.mu.Unlock()
+		return false
+	}
+	if c.state == StateReconnecting {
+		// The heartbeat and keepalive loops can both observe a failed
+		// connection; whichever gets here first does the redialing. The
+		// state check and transition must happen atomically under mu, or
+		// both loops could see StateConnected and race to redial.
+		c.mu.Unlock()
+		return true
+	}
+	old := c.state
+	c.state = StateReconnecting
+	c.generation++
+	cb := c.onStateChange
+	c.conn.Close()
+	c.mu.Unlock()
+
+	if cb != nil {
+		cb(old, StateReconnecting)
+	}
+
+	// None of the pending pipelined calls can be satisfied by the dead
+	// connection; fail them now instead of waiting for the (possibly
+	// already-gone) reader goroutine to notice the same thing.
+	c.resetPipelineState(ErrReconnecting)
+
+	backoff := reconnectInitialBackoff
+	for {
+		select {
+		case <-c.closeCh:
+			return false
+		case <-time.After(backoff):
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.heartbeatTimeout)
+		conn, err := c.dial(ctx, c.address)
+		cancel()
+		if err != nil {
+			c.logger.Warn("failed to reconnect", zap.Error(err), zap.Duration("backoff", backoff))
+			backoff = c.nextBackoff(backoff)
+			continue
+		}
+
+		c.mu.Lock()
+		if c.state == StateClosed {
+			// Close() ran while we were dialing; don't resurrect the
+			// client with a connection and reader goroutine nobody will
+			// ever tear down.
+			c.mu.Unlock()
+			conn.Close()
+			return false
+		}
+		c.conn = conn
+		c.poisonErr = nil
+		c.mu.Unlock()
+
+		ctx, cancel = context.WithTimeout(context.Background(), c.heartbeatTimeout)
+		if err := c.negotiateCapabilities(ctx); err != nil {
+			c.logger.Warn("failed to renegotiate capabilities after reconnect", zap.Error(err))
+		}
+		cancel()
+
+		c.setState(StateConnected)
+
+		return true
+	}
+}
+
+// nextBackoff doubles backoff (capped at c.heartbeatTimeout) and applies
+// jitter, so that many clients reconnecting to the same server don't all
+// retry in lockstep.
+func (c *Client) nextBackoff(backoff time.Duration) time.Duration {
+	backoff *= 2
+	if backoff > c.heartbeatTimeout {
+		backoff = c.heartbeatTimeout
+	}
+
+	jitter := time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+
+	return backoff/2 + jitter
+}
+
+// keepaliveLoop sends a ping on every KeepaliveInterval tick, independently
+// of the heartbeat loop's own cadence, and reconnects if a probe fails.
+func (c *Client) keepaliveLoop() {
+	ticker := time.NewTicker(c.KeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.closeCh:
 			return
+		case <-ticker.C:
+			if !c.probe() {
+				return
+			}
+		}
+	}
+}
+
+// probe sends a single ping with a random amount of padding and waits for
+// the matching pong, reconnecting if none arrives within the keepalive
+// timeout. Returns false if the client was closed while reconnecting.
+func (c *Client) probe() bool {
+	maxPadding := c.keepalivePadding()
+	padding := make([]byte, rand.Intn(maxPadding+1))
+	if _, err := rand.Read(padding); err != nil {
+		c.logger.Warn("failed to generate keepalive padding", zap.Error(err))
+	}
+
+	request := Message{}
+	request.Init(messageHeaderSize + maxPadding + 1)
+	response := Message{}
+	response.Init(16)
+
+	EncodePing(&request, padding)
+
+	timeout := c.keepaliveTimeout()
+
+	// Call already honors ctx via SetDeadline, but time.AfterFunc gives us
+	// a second, independent trigger to unstick a read should the
+	// connection wedge in a way the deadline alone doesn't catch.
+	// The callback works on the connection captured here rather than taking
+	// c.mu, which callSerialized holds for the whole round-trip.
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	timer := time.AfterFunc(timeout, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	err := c.Call(ctx, &request, &response)
+	cancel()
+
+	// Stop the deadline-poisoning timer before doing anything else, so it
+	// can't fire on a connection whose probe has already come back. Since
+	// its callback is bound to the connection the probe was sent on, it
+	// never touches a replacement connection dialed by reconnect(). A
+	// deferred Stop() would run too late, since Go evaluates
+	// the return expression (including a call to reconnect()) before
+	// running deferred statements.
+	timer.Stop()
+
+	if err != nil {
+		if err == ErrReconnecting {
+			// The heartbeat loop is already redialing; nothing new
+			// to report or act on.
+			return true
 		}
+
+		c.logger.Warn("keepalive probe failed", zap.Error(err))
+		return c.reconnect()
+	}
+
+	if err := DecodePong(&response); err != nil {
+		c.logger.Warn("invalid keepalive response", zap.Error(err))
+		return c.reconnect()
+	}
+
+	return true
+}
+
+func (c *Client) keepaliveTimeout() time.Duration {
+	if c.KeepaliveTimeout > 0 {
+		return c.KeepaliveTimeout
+	}
+	return defaultKeepaliveTimeout
+}
+
+func (c *Client) keepalivePadding() int {
+	padding := defaultKeepalivePadding
+	if c.KeepalivePadding > 0 {
+		padding = c.KeepalivePadding
+	}
+	// EncodePing's length prefix for the padding is a single byte, so
+	// anything beyond this doesn't fit the wire format; clamp rather than
+	// let a misconfigured field corrupt the frame or overflow the request
+	// buffer sized off of it.
+	if padding > defaultKeepalivePadding {
+		padding = defaultKeepalivePadding
 	}
+	return padding
 }
\ No newline at end of file
@@ -0,0 +1,303 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TestResetPipelineState verifies that reconnect()'s synchronous teardown
+// path disables pipelining, clears any calls left waiting on the dead
+// connection's reader goroutine, and delivers err to each of them.
+func TestResetPipelineState(t *testing.T) {
+	c := &Client{
+		pipelining:    true,
+		readerStarted: true,
+		pending:       make(map[uint16]pendingCall),
+	}
+
+	done := make(chan error, 1)
+	c.pending[7] = pendingCall{response: &Message{}, done: done}
+
+	c.resetPipelineState(ErrReconnecting)
+
+	if c.pipelining {
+		t.Fatal("pipelining should be disabled after resetPipelineState")
+	}
+	if c.readerStarted {
+		t.Fatal("readerStarted should be cleared after resetPipelineState")
+	}
+	if len(c.pending) != 0 {
+		t.Fatalf("pending should be empty after resetPipelineState, got %d entries", len(c.pending))
+	}
+
+	select {
+	case err := <-done:
+		if err != ErrReconnecting {
+			t.Fatalf("expected ErrReconnecting, got %v", err)
+		}
+	default:
+		t.Fatal("pending call was not notified of the reset")
+	}
+}
+
+// TestCallPipelinedScrubsPendingOnCancellation verifies that a call whose
+// context is cancelled before the response arrives removes its own entry
+// from c.pending, instead of leaving it registered for the reader goroutine
+// to resolve (or leak) later.
+func TestCallPipelinedScrubsPendingOnCancellation(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	c := newClient(clientConn, "test", nil, nil, zap.NewNop())
+	c.pipelining = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Cancel only once the request starts reaching the server, by which
+	// time callPipelined has registered it in c.pending, then drain the
+	// rest so send() doesn't block on the unbuffered pipe. No response is
+	// ever written back.
+	go func() {
+		first := make([]byte, 1)
+		serverConn.Read(first)
+		cancel()
+		io.Copy(io.Discard, serverConn)
+	}()
+
+	request := Message{}
+	request.Init(16)
+	response := Message{}
+	response.Init(16)
+
+	if err := c.callPipelined(ctx, &request, &response); err != ctx.Err() {
+		t.Fatalf("expected %v, got %v", ctx.Err(), err)
+	}
+
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if len(c.pending) != 0 {
+		t.Fatalf("cancelled call left %d entries in pending, want 0", len(c.pending))
+	}
+}
+
+// TestCallPipelinedCancellationDoesNotDeleteReusedID reproduces the request
+// id wraparound race: if the reader goroutine has already popped a
+// cancelled call's entry and a later call reused the same id before the
+// cancelled call gets the lock, the cancelled call must not delete the
+// later call's entry out from under it.
+func TestCallPipelinedCancellationDoesNotDeleteReusedID(t *testing.T) {
+	c := &Client{pending: make(map[uint16]pendingCall)}
+
+	const id = uint16(42)
+	staleDone := make(chan error, 1)
+	c.pending[id] = pendingCall{response: &Message{}, done: staleDone}
+
+	// Simulate the reader goroutine winning the race: it pops the stale
+	// entry and a new call reuses id before the cancelled call's ctx.Done
+	// branch gets c.pendingMu.
+	c.pendingMu.Lock()
+	delete(c.pending, id)
+	newDone := make(chan error, 1)
+	c.pending[id] = pendingCall{response: &Message{}, done: newDone}
+	c.pendingMu.Unlock()
+
+	// This mirrors callPipelined's ctx.Done() branch: it must only delete
+	// the entry if it still holds the same channel it registered.
+	c.pendingMu.Lock()
+	if cur, ok := c.pending[id]; ok && cur.done == staleDone {
+		delete(c.pending, id)
+	}
+	c.pendingMu.Unlock()
+
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if _, ok := c.pending[id]; !ok {
+		t.Fatal("stale cancellation deleted the reused id's new entry")
+	}
+}
+
+// TestPipelineReaderLoopDrainsOrphanedResponse verifies that an orphaned
+// response (one whose id nobody is waiting on, e.g. because the caller's
+// ctx was cancelled) is fully drained before the reader goes back to
+// recvHeader for the next frame. Before this fix, the discard Message
+// never had its words/flags copied from the header, so recvBody read zero
+// bytes of the orphan's body, leaving it in the socket to be misread as
+// the next frame's header - permanently desyncing every response after it.
+func TestPipelineReaderLoopDrainsOrphanedResponse(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	consumer := newClient(clientConn, "test", nil, nil, zap.NewNop())
+	consumer.pipelining = true
+	consumer.readerGeneration = 1
+
+	matchedResponse := Message{}
+	matchedResponse.Init(64)
+	done := make(chan error, 1)
+	consumer.pending[5] = pendingCall{response: &matchedResponse, done: done}
+
+	go consumer.pipelineReaderLoop(1)
+
+	server := newClient(serverConn, "test", nil, nil, zap.NewNop())
+
+	// An orphaned response nobody is waiting for - id 9 has no pending
+	// entry - followed by a real one the consumer is waiting on.
+	orphan := Message{}
+	orphan.Init(32)
+	orphan.body1.Offset = 32
+	copy(orphan.body1.Bytes, bytes.Repeat([]byte{'o'}, 32))
+	setTestResponseHeader(&orphan, 9, 32)
+	if err := server.send(&orphan); err != nil {
+		t.Fatalf("failed to send orphaned response: %v", err)
+	}
+
+	payload := bytes.Repeat([]byte{'m'}, 64)
+	matched := Message{}
+	matched.Init(64)
+	matched.body1.Offset = 64
+	copy(matched.body1.Bytes, payload)
+	setTestResponseHeader(&matched, 5, 64)
+	if err := server.send(&matched); err != nil {
+		t.Fatalf("failed to send matched response: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("matched call failed: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("matched call never completed - the orphaned frame likely desynced the stream")
+	}
+
+	if !bytes.Equal(matchedResponse.body1.Bytes[:64], payload) {
+		t.Fatal("matched response body does not match what was sent")
+	}
+}
+
+// setTestResponseHeader patches m's header with a body word count and
+// request id, the same way compressBody and setRequestID patch the raw
+// header bytes that actually reach the wire.
+func setTestResponseHeader(m *Message, id uint16, bodyLen int) {
+	words := uint32(bodyLen / messageWordSize)
+	binary.LittleEndian.PutUint32(m.header[0:], words)
+	m.words = words
+	m.extra = id
+	binary.LittleEndian.PutUint16(m.header[6:], id)
+}
+
+// TestCompressBodyPatchesHeader verifies that compressing a body patches
+// the new word count and flags byte into req.header itself, not just into
+// the parsed req.words/req.flags fields: sendHeader writes req.header
+// verbatim, so those are the only bytes that actually reach the wire.
+func TestCompressBodyPatchesHeader(t *testing.T) {
+	req := Message{}
+	req.Init(compressionThreshold * 2)
+
+	plain := bytes.Repeat([]byte{'a'}, compressionThreshold+1)
+	copy(req.body1.Bytes, plain)
+	req.body1.Offset = len(plain)
+
+	c := &Client{}
+	if err := c.compressBody(&req); err != nil {
+		t.Fatalf("compressBody failed: %v", err)
+	}
+
+	if req.flags&flagCompressed == 0 {
+		t.Fatal("flagCompressed not set after compressing a body above the threshold")
+	}
+	if req.header[5] != req.flags {
+		t.Fatalf("header flags byte = %#x, want %#x (req.flags)", req.header[5], req.flags)
+	}
+	if got := binary.LittleEndian.Uint32(req.header[0:4]); got != req.words {
+		t.Fatalf("header word count = %d, want %d (req.words)", got, req.words)
+	}
+}
+
+// TestCompressBodySendRecvRoundTrip exercises compression end to end over a
+// real connection: send() on one side, recv() on the other. Before
+// compressBody patched req.header (not just req.words/req.flags), the peer
+// would wait on the old, uncompressed word count for a body that had
+// already finished arriving - a permanent stream desync, not just a wrong
+// value.
+func TestCompressBodySendRecvRoundTrip(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+
+	sender := newClient(clientConn, "test", nil, nil, zap.NewNop())
+	sender.compression = true
+	receiver := newClient(serverConn, "test", nil, nil, zap.NewNop())
+
+	plain := bytes.Repeat([]byte("dqlite-compression-round-trip-"), 500)
+
+	req := Message{}
+	req.Init(len(plain))
+	copy(req.body1.Bytes, plain)
+	req.body1.Offset = len(plain)
+
+	sendErr := make(chan error, 1)
+	go func() { sendErr <- sender.send(&req) }()
+
+	res := Message{}
+	res.Init(16)
+	if err := receiver.recv(&res); err != nil {
+		t.Fatalf("recv failed: %v", err)
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+
+	var got []byte
+	if len(plain) <= len(res.body1.Bytes) {
+		got = res.body1.Bytes[:len(plain)]
+	} else {
+		got = res.body2.Bytes[:len(plain)]
+	}
+
+	if !bytes.Equal(got, plain) {
+		t.Fatal("decompressed body does not match the original payload")
+	}
+}
+
+// TestNegotiateCapabilitiesResetsCompressionOnFailure verifies that a
+// failed (re)negotiation - e.g. because reconnect() dialed a different,
+// less capable cluster member - leaves compression disabled rather than
+// keeping whatever the previous connection had negotiated.
+func TestNegotiateCapabilitiesResetsCompressionOnFailure(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	serverConn.Close()
+	defer clientConn.Close()
+
+	c := newClient(clientConn, "test", nil, nil, zap.NewNop())
+	c.compression = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := c.negotiateCapabilities(ctx); err != nil {
+		t.Fatalf("negotiateCapabilities returned an error: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.compression {
+		t.Fatal("compression should be reset to false when negotiation fails")
+	}
+}
+
+func TestKeepalivePaddingClamped(t *testing.T) {
+	c := &Client{KeepalivePadding: defaultKeepalivePadding + 1000}
+	if got := c.keepalivePadding(); got != defaultKeepalivePadding {
+		t.Fatalf("keepalivePadding() = %d, want clamped to %d", got, defaultKeepalivePadding)
+	}
+}